@@ -27,10 +27,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/rackspace/gophercloud"
-	"github.com/rackspace/gophercloud/openstack"
-	"github.com/rackspace/gophercloud/openstack/compute/v2/servers"
-	"github.com/rackspace/gophercloud/pagination"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/pagination"
 	"github.com/scalingdata/gcfg"
 
 	"github.com/golang/glog"
@@ -63,6 +63,15 @@ func (d *MyDuration) UnmarshalText(text []byte) error {
 type RouteOpts struct {
 	RouterId         string `gcfg:"router-id"` // required
 	HostnameOverride bool   `gcfg:"hostname-override"`
+	Distributed      bool   `gcfg:"distributed"` // require the router to be a Distributed Virtual Router
+	HA               bool   `gcfg:"ha"`          // require the router to be highly-available
+
+	// SubnetPoolId, when set, has the route controller allocate a fresh
+	// subnet from this Neutron subnet pool for each node that doesn't
+	// already have a pod CIDR, instead of requiring the operator to
+	// pre-carve them.
+	SubnetPoolId     string `gcfg:"subnet-pool-id"`
+	NodeCIDRMaskSize int    `gcfg:"node-cidr-mask-size"`
 }
 
 type LoadBalancerOpts struct {
@@ -83,25 +92,41 @@ type OpenStack struct {
 	region    string
 	lbOpts    LoadBalancerOpts
 	routeOpts RouteOpts
+	bsOpts    BlockStorageOpts
 	// InstanceID of the server where this OpenStack object is instantiated.
 	localInstanceID string
+	// AvailabilityZone of the server where this OpenStack object is instantiated.
+	localAvailabilityZone string
 }
 
 type Config struct {
 	Global struct {
-		AuthUrl    string `gcfg:"auth-url"`
-		Username   string
-		UserId     string `gcfg:"user-id"`
-		Password   string
+		AuthUrl  string `gcfg:"auth-url"`
+		Username string
+		UserId   string `gcfg:"user-id"`
+		Password string
+		// ApiKey is deprecated: it was only ever meaningful against the
+		// Rackspace-specific auth extension that the rackspace/gophercloud
+		// fork implemented, which gophercloud/gophercloud does not carry.
+		// Kept parseable so existing cloud.conf files don't fail to load.
 		ApiKey     string `gcfg:"api-key"`
 		TenantId   string `gcfg:"tenant-id"`
 		TenantName string `gcfg:"tenant-name"`
 		DomainId   string `gcfg:"domain-id"`
 		DomainName string `gcfg:"domain-name"`
 		Region     string
+
+		// Keystone v3 auth.
+		TokenID                     string `gcfg:"token-id"`
+		ApplicationCredentialID     string `gcfg:"application-credential-id"`
+		ApplicationCredentialName   string `gcfg:"application-credential-name"`
+		ApplicationCredentialSecret string `gcfg:"application-credential-secret"`
+		ProjectDomainName           string `gcfg:"project-domain-name"`
+		UserDomainName              string `gcfg:"user-domain-name"`
 	}
 	LoadBalancer LoadBalancerOpts
 	Route        RouteOpts
+	BlockStorage BlockStorageOpts
 }
 
 func init() {
@@ -114,19 +139,59 @@ func init() {
 	})
 }
 
+// useV3Auth reports whether any Keystone v3-only field has been configured,
+// so newOpenStack knows to authenticate against the v3 identity API instead
+// of v2.
+func (cfg Config) useV3Auth() bool {
+	g := cfg.Global
+	return g.DomainId != "" || g.DomainName != "" || g.TokenID != "" ||
+		g.ApplicationCredentialID != "" || g.ApplicationCredentialName != "" ||
+		g.ProjectDomainName != "" || g.UserDomainName != ""
+}
+
 func (cfg Config) toAuthOptions() gophercloud.AuthOptions {
-	return gophercloud.AuthOptions{
-		IdentityEndpoint: cfg.Global.AuthUrl,
-		Username:         cfg.Global.Username,
-		UserID:           cfg.Global.UserId,
-		Password:         cfg.Global.Password,
-		APIKey:           cfg.Global.ApiKey,
-		TenantID:         cfg.Global.TenantId,
-		TenantName:       cfg.Global.TenantName,
+	g := cfg.Global
+
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: g.AuthUrl,
+		Username:         g.Username,
+		UserID:           g.UserId,
+		Password:         g.Password,
+		TokenID:          g.TokenID,
+		TenantID:         g.TenantId,
+		TenantName:       g.TenantName,
+		DomainID:         g.DomainId,
+		DomainName:       g.UserDomainName,
+
+		ApplicationCredentialID:     g.ApplicationCredentialID,
+		ApplicationCredentialName:   g.ApplicationCredentialName,
+		ApplicationCredentialSecret: g.ApplicationCredentialSecret,
 
 		// Persistent service, so we need to be able to renew tokens.
 		AllowReauth: true,
 	}
+
+	// DomainName scopes the user; ProjectDomainName scopes the project the
+	// user authenticates into. They only differ in multi-domain deployments,
+	// so fall back to the user's domain when the project one isn't set.
+	if g.UserDomainName == "" {
+		opts.DomainName = g.DomainName
+	}
+	if g.TenantName != "" || g.TenantId != "" {
+		projectDomainName := g.ProjectDomainName
+		if projectDomainName == "" {
+			projectDomainName = opts.DomainName
+		}
+		if projectDomainName != "" {
+			opts.Scope = &gophercloud.AuthScope{
+				ProjectName: g.TenantName,
+				ProjectID:   g.TenantId,
+				DomainName:  projectDomainName,
+			}
+		}
+	}
+
+	return opts
 }
 
 func readConfig(config io.Reader) (Config, error) {
@@ -141,16 +206,50 @@ func readConfig(config io.Reader) (Config, error) {
 }
 
 func newOpenStack(cfg Config) (*OpenStack, error) {
-	provider, err := openstack.AuthenticatedClient(cfg.toAuthOptions())
+	if cfg.Global.ApiKey != "" {
+		glog.Warning("The 'api-key' cloud.conf option is deprecated and ignored now that this provider uses gophercloud/gophercloud instead of the Rackspace fork; use Keystone v3 application credentials instead")
+	}
+
+	provider, err := openstack.NewClient(cfg.Global.AuthUrl)
 	if err != nil {
 		return nil, err
 	}
 
+	authOpts := cfg.toAuthOptions()
+	eo := gophercloud.EndpointOpts{Region: cfg.Global.Region}
+
+	if cfg.useV3Auth() {
+		glog.V(2).Info("Authenticating against the Keystone v3 identity API")
+		if err := openstack.AuthenticateV3(provider, authOpts, eo); err != nil {
+			return nil, err
+		}
+		// Keystone v3 tokens expire after ~24h; wiring the v3 identity
+		// endpoint into ReauthFunc keeps long-running controllers from
+		// silently losing auth once the initial token expires.
+		if _, err := openstack.NewIdentityV3(provider, eo); err != nil {
+			return nil, fmt.Errorf("failed to reach Keystone v3 identity endpoint for token renewal: %v", err)
+		}
+		provider.ReauthFunc = func() error {
+			return openstack.AuthenticateV3(provider, authOpts, eo)
+		}
+	} else {
+		if err := openstack.Authenticate(provider, authOpts); err != nil {
+			return nil, err
+		}
+	}
+
 	id, err := readInstanceID()
 	if err != nil {
 		glog.Info("Not running on an OpenStack Instance")
 	}
 
+	az := ""
+	if md, err := readInstanceMetadata(); err != nil {
+		glog.Warningf("Could not determine availability zone from metadata or config drive: %v", err)
+	} else {
+		az = md.AvailabilityZone
+	}
+
 	network, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
 		Region: cfg.Global.Region,
 	})
@@ -167,14 +266,32 @@ func newOpenStack(cfg Config) (*OpenStack, error) {
 		return nil, err
 	}
 
+	if cfg.Route.RouterId != "" {
+		if err := validateRouterMode(network, cfg.Route); err != nil {
+			return nil, err
+		}
+	}
+
+	if az == "" && id != "" {
+		// Metadata service and config drive were both unavailable (e.g. no
+		// network route to 169.254.169.254); ask Nova directly instead.
+		if novaAZ, err := readInstanceAvailabilityZoneFromNova(compute, id); err != nil {
+			glog.Warningf("Could not determine availability zone from Nova: %v", err)
+		} else {
+			az = novaAZ
+		}
+	}
+
 	os := OpenStack{
-		compute:         compute,
-		network:         network,
-		provider:        provider,
-		region:          cfg.Global.Region,
-		lbOpts:          cfg.LoadBalancer,
-		routeOpts:       cfg.Route,
-		localInstanceID: id,
+		compute:               compute,
+		network:               network,
+		provider:              provider,
+		region:                cfg.Global.Region,
+		lbOpts:                cfg.LoadBalancer,
+		routeOpts:             cfg.Route,
+		bsOpts:                cfg.BlockStorage,
+		localInstanceID:       id,
+		localAvailabilityZone: az,
 	}
 	return &os, nil
 }
@@ -373,6 +490,39 @@ func getAddressByName(api *gophercloud.ServiceClient, name string) (string, erro
 	return s, nil
 }
 
+// getServerNameByAddress finds the compute instance whose fixed, floating,
+// or access IP matches address and returns its name. This is the reverse of
+// getAddressByName, used to resolve a Neutron router extraroute's nexthop
+// back to a node name.
+func getServerNameByAddress(api *gophercloud.ServiceClient, address string) (string, error) {
+	var found string
+	err := servers.List(api, servers.ListOpts{Status: "ACTIVE"}).EachPage(func(page pagination.Page) (bool, error) {
+		list, err := servers.ExtractServers(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range list {
+			srv := &list[i]
+			addrs := append(findAddrs(srv.Addresses, "fixed"), findAddrs(srv.Addresses, "floating")...)
+			addrs = append(addrs, srv.AccessIPv4, srv.AccessIPv6)
+			for _, a := range addrs {
+				if a == address {
+					found = srv.Name
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", ErrNotFound
+	}
+	return found, nil
+}
+
 func (os *OpenStack) Clusters() (cloudprovider.Clusters, bool) {
 	return nil, false
 }
@@ -397,9 +547,13 @@ func (os *OpenStack) Zones() (cloudprovider.Zones, bool) {
 	return os, true
 }
 func (os *OpenStack) GetZone() (cloudprovider.Zone, error) {
-	glog.V(1).Infof("Current zone is %v", os.region)
+	zone := cloudprovider.Zone{
+		FailureDomain: os.localAvailabilityZone,
+		Region:        os.region,
+	}
+	glog.V(1).Infof("Current zone is %v", zone)
 
-	return cloudprovider.Zone{Region: os.region}, nil
+	return zone, nil
 }
 
 func getServerByAddress(compute *gophercloud.ServiceClient, ip string) (*servers.Server, error) {
@@ -0,0 +1,456 @@
+/*
+Copyright 2014 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/monitors"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/gophercloud/gophercloud/pagination"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// loadbalancerActiveInitDelay, loadbalancerActiveFactor and
+// loadbalancerActiveSteps control how long we poll Neutron for a
+// loadbalancer/listener/pool/monitor to leave PENDING_* and reach ACTIVE
+// provisioning status between every step of the Ensure flow below.
+const (
+	loadbalancerActiveInitDelay = 1 * time.Second
+	loadbalancerActiveFactor    = 1.2
+	loadbalancerActiveSteps     = 25
+
+	activeStatus = "ACTIVE"
+	errorStatus  = "ERROR"
+)
+
+// LoadBalancer returns an implementation of TCPLoadBalancer for OpenStack.
+func (os *OpenStack) LoadBalancer() (cloudprovider.TCPLoadBalancer, bool) {
+	glog.V(1).Info("Claiming to support TCPLoadBalancer")
+
+	return os, true
+}
+
+func waitLoadbalancerActiveProvisioningStatus(network *gophercloud.ServiceClient, loadbalancerID string) (string, error) {
+	delay := loadbalancerActiveInitDelay
+	for i := 0; i < loadbalancerActiveSteps; i++ {
+		lb, err := loadbalancers.Get(network, loadbalancerID).Extract()
+		if err != nil {
+			return "", err
+		}
+		if lb.ProvisioningStatus == activeStatus {
+			return activeStatus, nil
+		}
+		if lb.ProvisioningStatus == errorStatus {
+			return lb.ProvisioningStatus, fmt.Errorf("loadbalancer %s entered ERROR provisioning status", loadbalancerID)
+		}
+		time.Sleep(delay)
+		delay = time.Duration(float64(delay) * loadbalancerActiveFactor)
+	}
+	return "", fmt.Errorf("loadbalancer %s did not become ACTIVE after %d attempts", loadbalancerID, loadbalancerActiveSteps)
+}
+
+func waitLoadbalancerDeleted(network *gophercloud.ServiceClient, loadbalancerID string) error {
+	delay := loadbalancerActiveInitDelay
+	for i := 0; i < loadbalancerActiveSteps; i++ {
+		_, err := loadbalancers.Get(network, loadbalancerID).Extract()
+		if err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		time.Sleep(delay)
+		delay = time.Duration(float64(delay) * loadbalancerActiveFactor)
+	}
+	return fmt.Errorf("loadbalancer %s was not deleted in time", loadbalancerID)
+}
+
+// poolDescriptionPrefix tags a pool's Description with the node port its
+// members should be created against, since Neutron pools have no dedicated
+// field for it and UpdateTCPLoadBalancer needs to recover the port when
+// adding a member back to a pool that currently has none to infer it from.
+const poolDescriptionPrefix = "kubernetes-node-port="
+
+func poolDescription(nodePort int) string {
+	return fmt.Sprintf("%s%d", poolDescriptionPrefix, nodePort)
+}
+
+func poolNodePort(pool *pools.Pool) (int, error) {
+	var port int
+	if _, err := fmt.Sscanf(pool.Description, poolDescriptionPrefix+"%d", &port); err != nil {
+		return 0, fmt.Errorf("pool %s has no recoverable node port in its description %q: %v", pool.ID, pool.Description, err)
+	}
+	return port, nil
+}
+
+func toLBMethod(method string) pools.LBMethod {
+	switch method {
+	case "ROUND_ROBIN":
+		return pools.LBMethodRoundRobin
+	case "LEAST_CONNECTIONS":
+		return pools.LBMethodLeastConnections
+	case "SOURCE_IP":
+		return pools.LBMethodSourceIP
+	default:
+		return pools.LBMethodRoundRobin
+	}
+}
+
+func getLoadbalancerByName(network *gophercloud.ServiceClient, name string) (*loadbalancers.LoadBalancer, error) {
+	var lb *loadbalancers.LoadBalancer
+	err := loadbalancers.List(network, loadbalancers.ListOpts{Name: name}).EachPage(func(page pagination.Page) (bool, error) {
+		lbList, err := loadbalancers.ExtractLoadBalancers(page)
+		if err != nil {
+			return false, err
+		}
+		if len(lbList) > 1 {
+			return false, ErrMultipleResults
+		}
+		if len(lbList) == 1 {
+			lb = &lbList[0]
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lb == nil {
+		return nil, ErrNotFound
+	}
+	return lb, nil
+}
+
+// GetTCPLoadBalancer returns whether the named load balancer exists, and if
+// so its VIP address as the ingress. A floating IP associated with the VIP
+// port is not looked up or reported.
+func (os *OpenStack) GetTCPLoadBalancer(name, region string) (*api.LoadBalancerStatus, bool, error) {
+	lb, err := getLoadbalancerByName(os.network, name)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	status := &api.LoadBalancerStatus{}
+	status.Ingress = append(status.Ingress, api.LoadBalancerIngress{IP: lb.VipAddress})
+	return status, true, nil
+}
+
+// EnsureTCPLoadBalancer creates a Neutron LBaaS v2 loadbalancer fronting the
+// given service ports on the given hosts. A loadbalancer that already exists
+// under that name is reused, but a listener, pool, members and monitor are
+// created on it for every port, and a floating IP is allocated, without
+// checking for ones that already exist.
+func (os *OpenStack) EnsureTCPLoadBalancer(name, region string, loadBalancerIP net.IP, ports []*api.ServicePort, hosts []string, affinity api.ServiceAffinity) (*api.LoadBalancerStatus, error) {
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports provided for load balancer %s", name)
+	}
+	if os.lbOpts.SubnetId == "" {
+		return nil, fmt.Errorf("no subnet-id configured in cloud provider config for load balancer %s", name)
+	}
+
+	lb, err := getLoadbalancerByName(os.network, name)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if lb == nil {
+		glog.V(2).Infof("Creating load balancer %s for %d ports on subnet %s", name, len(ports), os.lbOpts.SubnetId)
+
+		lb, err = loadbalancers.Create(os.network, loadbalancers.CreateOpts{
+			Name:        name,
+			Description: fmt.Sprintf("Kubernetes service %s", name),
+			VipSubnetID: os.lbOpts.SubnetId,
+		}).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create loadbalancer %s: %v", name, err)
+		}
+	} else {
+		glog.V(2).Infof("Load balancer %s already exists, reusing it for %d ports on subnet %s", name, len(ports), os.lbOpts.SubnetId)
+	}
+
+	if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+		return nil, err
+	}
+
+	lbMethod := toLBMethod(os.lbOpts.LBMethod)
+
+	for _, port := range ports {
+		listener, err := listeners.Create(os.network, listeners.CreateOpts{
+			Name:           fmt.Sprintf("%s-%d", name, port.Port),
+			Protocol:       listeners.ProtocolTCP,
+			ProtocolPort:   port.Port,
+			LoadbalancerID: lb.ID,
+		}).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener for port %d: %v", port.Port, err)
+		}
+		if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+			return nil, err
+		}
+
+		pool, err := pools.Create(os.network, pools.CreateOpts{
+			Name:        fmt.Sprintf("%s-%d", name, port.Port),
+			Description: poolDescription(port.NodePort),
+			Protocol:    pools.ProtocolTCP,
+			LBMethod:    lbMethod,
+			ListenerID:  listener.ID,
+		}).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pool for port %d: %v", port.Port, err)
+		}
+		if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+			return nil, err
+		}
+
+		for _, host := range hosts {
+			addr, err := getAddressByName(os.compute, host)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve address of host %s: %v", host, err)
+			}
+			_, err = pools.CreateMember(os.network, pool.ID, pools.CreateMemberOpts{
+				Address:      addr,
+				ProtocolPort: port.NodePort,
+				SubnetID:     os.lbOpts.SubnetId,
+			}).Extract()
+			if err != nil {
+				return nil, fmt.Errorf("failed to add member %s to pool %s: %v", host, pool.ID, err)
+			}
+			if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		if os.lbOpts.CreateMonitor {
+			_, err := monitors.Create(os.network, monitors.CreateOpts{
+				PoolID:     pool.ID,
+				Type:       monitors.TypeTCP,
+				Delay:      int(os.lbOpts.MonitorDelay.Duration.Seconds()),
+				Timeout:    int(os.lbOpts.MonitorTimeout.Duration.Seconds()),
+				MaxRetries: int(os.lbOpts.MonitorMaxRetries),
+			}).Extract()
+			if err != nil {
+				return nil, fmt.Errorf("failed to create health monitor for pool %s: %v", pool.ID, err)
+			}
+			if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	status := &api.LoadBalancerStatus{}
+
+	if os.lbOpts.FloatingNetworkId != "" {
+		floatIP, err := floatingips.Create(os.network, floatingips.CreateOpts{
+			FloatingNetworkID: os.lbOpts.FloatingNetworkId,
+			PortID:            lb.VipPortID,
+		}).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate floating IP for loadbalancer %s: %v", name, err)
+		}
+		status.Ingress = append(status.Ingress, api.LoadBalancerIngress{IP: floatIP.FloatingIP})
+	} else {
+		status.Ingress = append(status.Ingress, api.LoadBalancerIngress{IP: lb.VipAddress})
+	}
+
+	return status, nil
+}
+
+// UpdateTCPLoadBalancer reconciles the pool membership of an existing load
+// balancer with the given set of hosts.
+func (os *OpenStack) UpdateTCPLoadBalancer(name, region string, hosts []string) error {
+	lb, err := getLoadbalancerByName(os.network, name)
+	if err != nil {
+		return err
+	}
+
+	listenerList, err := listListenersForLoadbalancer(os.network, lb.ID)
+	if err != nil {
+		return err
+	}
+
+	wantAddrs := make(map[string]bool)
+	for _, host := range hosts {
+		addr, err := getAddressByName(os.compute, host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve address of host %s: %v", host, err)
+		}
+		wantAddrs[addr] = true
+	}
+
+	for _, listener := range listenerList {
+		pool, err := getPoolForListener(os.network, listener.ID)
+		if err != nil {
+			return err
+		}
+
+		haveAddrs := make(map[string]string)
+		for _, memberID := range pool.Members {
+			member, err := pools.GetMember(os.network, pool.ID, memberID).Extract()
+			if err != nil {
+				return err
+			}
+			haveAddrs[member.Address] = member.ID
+		}
+
+		for addr := range wantAddrs {
+			if _, ok := haveAddrs[addr]; !ok {
+				port, err := poolNodePort(pool)
+				if err != nil {
+					return err
+				}
+				_, err = pools.CreateMember(os.network, pool.ID, pools.CreateMemberOpts{
+					Address:      addr,
+					ProtocolPort: port,
+					SubnetID:     os.lbOpts.SubnetId,
+				}).Extract()
+				if err != nil {
+					return fmt.Errorf("failed to add member %s to pool %s: %v", addr, pool.ID, err)
+				}
+				if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+					return err
+				}
+			}
+		}
+
+		for addr, memberID := range haveAddrs {
+			if !wantAddrs[addr] {
+				if err := pools.DeleteMember(os.network, pool.ID, memberID).ExtractErr(); err != nil && !isNotFound(err) {
+					return fmt.Errorf("failed to remove member %s from pool %s: %v", addr, pool.ID, err)
+				}
+				if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// EnsureTCPLoadBalancerDeleted tears down the named load balancer and every
+// child resource hanging off it, tolerating a 404 at each step since the
+// walk may be resumed after a partial failure.
+func (os *OpenStack) EnsureTCPLoadBalancerDeleted(name, region string) error {
+	lb, err := getLoadbalancerByName(os.network, name)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	listenerList, err := listListenersForLoadbalancer(os.network, lb.ID)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	for _, listener := range listenerList {
+		pool, err := getPoolForListener(os.network, listener.ID)
+		if err != nil {
+			if err == ErrNotFound || isNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, memberID := range pool.Members {
+			if err := pools.DeleteMember(os.network, pool.ID, memberID).ExtractErr(); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+
+		monitorID := pool.MonitorID
+		if monitorID != "" {
+			if err := monitors.Delete(os.network, monitorID).ExtractErr(); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+
+		if err := pools.Delete(os.network, pool.ID).ExtractErr(); err != nil && !isNotFound(err) {
+			return err
+		}
+		if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if err := listeners.Delete(os.network, listener.ID).ExtractErr(); err != nil && !isNotFound(err) {
+			return err
+		}
+		if _, err := waitLoadbalancerActiveProvisioningStatus(os.network, lb.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	if err := loadbalancers.Delete(os.network, lb.ID).ExtractErr(); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return waitLoadbalancerDeleted(os.network, lb.ID)
+}
+
+func listListenersForLoadbalancer(network *gophercloud.ServiceClient, loadbalancerID string) ([]listeners.Listener, error) {
+	var result []listeners.Listener
+	err := listeners.List(network, listeners.ListOpts{LoadbalancerID: loadbalancerID}).EachPage(func(page pagination.Page) (bool, error) {
+		l, err := listeners.ExtractListeners(page)
+		if err != nil {
+			return false, err
+		}
+		result = append(result, l...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func getPoolForListener(network *gophercloud.ServiceClient, listenerID string) (*pools.Pool, error) {
+	var found *pools.Pool
+	err := pools.List(network, pools.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+		poolList, err := pools.ExtractPools(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range poolList {
+			for _, l := range poolList[i].Listeners {
+				if l.ID == listenerID {
+					found = &poolList[i]
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2014 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+
+	"github.com/golang/glog"
+)
+
+// serverAttributesExt merges the base server representation with the
+// OS-EXT-AZ extension so a single Get call returns the availability zone.
+type serverAttributesExt struct {
+	servers.Server
+	availabilityzones.ServerAvailabilityZoneExt
+}
+
+const (
+	configDriveLabel     = "config-2"
+	configDriveMountPath = "openstack/latest/meta_data.json"
+	cloudInitDataPath    = "/run/cloud-init/instance-data.json"
+)
+
+// instanceMetadata is the subset of the OpenStack metadata document (or
+// cloud-init's normalized instance-data.json) this provider cares about.
+type instanceMetadata struct {
+	UUID             string `json:"uuid"`
+	Name             string `json:"name"`
+	AvailabilityZone string `json:"availability_zone"`
+}
+
+// cloudInitInstanceData mirrors the small slice of cloud-init's
+// instance-data.json that carries the same fields as meta_data.json, under
+// a "ds/meta_data" key.
+type cloudInitInstanceData struct {
+	DS struct {
+		MetaData instanceMetadata `json:"meta_data"`
+	} `json:"ds"`
+}
+
+// readInstanceMetadata fetches meta_data.json from the OpenStack metadata
+// service, falling back to a local config drive when the metadata service
+// is unreachable (e.g. the instance has no route to 169.254.169.254).
+func readInstanceMetadata() (*instanceMetadata, error) {
+	md, err := readMetadataService()
+	if err == nil {
+		return md, nil
+	}
+	glog.V(3).Infof("Cannot read metadata service: %v, trying config drive", err)
+
+	md, err = readConfigDriveMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("could not read instance metadata from metadata service or config drive: %v", err)
+	}
+	return md, nil
+}
+
+func readMetadataService() (*instanceMetadata, error) {
+	resp, err := http.Get(metadataUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got unexpected status code when reading metadata from %s: %s", metadataUrl, resp.Status)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &instanceMetadata{}
+	if err := json.Unmarshal(bodyBytes, md); err != nil {
+		return nil, err
+	}
+	if md.UUID == "" {
+		return nil, fmt.Errorf("cannot parse OpenStack metadata, got empty uuid")
+	}
+	return md, nil
+}
+
+// readConfigDriveMetadata reads instance metadata from a config drive,
+// trying cloud-init's normalized instance-data.json first (no mount
+// required) and falling back to mounting the ISO9660/vfat volume labeled
+// "config-2" that Nova attaches when config_drive=true.
+func readConfigDriveMetadata() (*instanceMetadata, error) {
+	if data, err := ioutil.ReadFile(cloudInitDataPath); err == nil {
+		var parsed cloudInitInstanceData
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, err
+		}
+		if parsed.DS.MetaData.UUID != "" {
+			return &parsed.DS.MetaData, nil
+		}
+	}
+
+	dev := "/dev/disk/by-label/" + configDriveLabel
+	if _, err := os.Stat(dev); os.IsNotExist(err) {
+		out, err := exec.Command("blkid", "-l", "-t", "LABEL="+configDriveLabel, "-o", "device").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("unable to run blkid: %v", err)
+		}
+		dev = strings.TrimSpace(string(out))
+	}
+
+	mntdir, err := ioutil.TempDir("", "configdrive")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(mntdir)
+
+	if err := exec.Command("mount", "-o", "ro", "-t", "auto", dev, mntdir).Run(); err != nil {
+		return nil, fmt.Errorf("unable to mount config drive %s: %v", dev, err)
+	}
+	defer exec.Command("umount", mntdir).Run()
+
+	data, err := ioutil.ReadFile(filepath.Join(mntdir, configDriveMountPath))
+	if err != nil {
+		return nil, err
+	}
+
+	md := &instanceMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, err
+	}
+	if md.UUID == "" {
+		return nil, fmt.Errorf("cannot parse config drive metadata, got empty uuid")
+	}
+	return md, nil
+}
+
+// readInstanceAvailabilityZoneFromNova asks Nova directly for the AZ of the
+// given instance, for use when the metadata service and config drive are
+// both unavailable.
+func readInstanceAvailabilityZoneFromNova(compute *gophercloud.ServiceClient, instanceID string) (string, error) {
+	var withAZ serverAttributesExt
+	if err := servers.Get(compute, instanceID).ExtractInto(&withAZ); err != nil {
+		return "", err
+	}
+	return withAZ.AvailabilityZone, nil
+}
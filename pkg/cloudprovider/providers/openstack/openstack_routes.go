@@ -0,0 +1,283 @@
+/*
+Copyright 2014 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+	"github.com/gophercloud/gophercloud/pagination"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+// defaultNodeCIDRMaskSize is used when SubnetPoolId is configured but
+// node-cidr-mask-size is left unset.
+const defaultNodeCIDRMaskSize = 24
+
+// routerHAExt merges the base router representation with the l3-ha
+// extension, which gophercloud's routers.Router does not carry.
+type routerHAExt struct {
+	routers.Router
+	HA bool `json:"ha"`
+}
+
+// Routes returns an implementation of Routes for OpenStack, if a router-id
+// has been configured for the routes subsystem to manage.
+func (os *OpenStack) Routes() (cloudprovider.Routes, bool) {
+	if os.routeOpts.RouterId == "" {
+		return nil, false
+	}
+
+	glog.V(1).Info("Claiming to support Routes")
+	return os, true
+}
+
+// validateRouterMode checks that the pre-existing Neutron router referenced
+// by RouteOpts.RouterId already has the DVR/HA mode the operator asked for.
+// Neutron does not allow converting an existing router's distributed flag,
+// so a mismatch here means the cluster would silently run centralized (or
+// fail to behave as expected) rather than the DVR topology the operator
+// configured; refuse to start instead.
+func validateRouterMode(network *gophercloud.ServiceClient, opts RouteOpts) error {
+	var router routerHAExt
+	if err := routers.Get(network, opts.RouterId).ExtractInto(&router); err != nil {
+		return fmt.Errorf("failed to look up router %s: %v", opts.RouterId, err)
+	}
+
+	if opts.Distributed && !router.Distributed {
+		return fmt.Errorf("router %s was created as a centralized router and cannot be converted to a Distributed Virtual Router; recreate it with distributed=true or unset the distributed option", opts.RouterId)
+	}
+	if opts.HA && !router.HA {
+		return fmt.Errorf("router %s was not created as a highly-available router and cannot be converted in place; recreate it with ha=true or unset the ha option", opts.RouterId)
+	}
+
+	return nil
+}
+
+// ListRoutes lists the extraroutes currently installed on the configured
+// router, resolving each nexthop IP back to the node name that owns it.
+func (os *OpenStack) ListRoutes(clusterName string) ([]*cloudprovider.Route, error) {
+	router, err := routers.Get(os.network, os.routeOpts.RouterId).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*cloudprovider.Route
+	for _, r := range router.Routes {
+		nodeName, err := getServerNameByAddress(os.compute, r.NextHop)
+		if err != nil {
+			glog.Warningf("Skipping route %s -> %s: could not resolve nexthop to a node: %v", r.DestinationCIDR, r.NextHop, err)
+			continue
+		}
+		result = append(result, &cloudprovider.Route{
+			Name:            clusterName + "-" + r.DestinationCIDR,
+			TargetInstance:  nodeName,
+			DestinationCIDR: r.DestinationCIDR,
+		})
+	}
+	return result, nil
+}
+
+// CreateRoute adds an extraroute for the given pod CIDR to the configured
+// router, pointed at the given node's fixed IP. If the route was not given a
+// destination CIDR and a subnet pool is configured, one is allocated from
+// the pool and written back onto route.DestinationCIDR so the caller can
+// persist it onto the Node object.
+func (os *OpenStack) CreateRoute(clusterName, nameHint string, route *cloudprovider.Route) error {
+	if route.DestinationCIDR == "" {
+		if os.routeOpts.SubnetPoolId == "" {
+			return fmt.Errorf("node %s has no pod CIDR and no subnet-pool-id is configured to allocate one", route.TargetInstance)
+		}
+		cidr, err := os.allocatePodSubnet(nameHint)
+		if err != nil {
+			return fmt.Errorf("failed to allocate a pod subnet for node %s: %v", route.TargetInstance, err)
+		}
+		route.DestinationCIDR = cidr
+	}
+
+	nextHop, err := getAddressByName(os.compute, route.TargetInstance)
+	if err != nil {
+		return fmt.Errorf("failed to resolve an address for node %s: %v", route.TargetInstance, err)
+	}
+
+	router, err := routers.Get(os.network, os.routeOpts.RouterId).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to look up router %s: %v", os.routeOpts.RouterId, err)
+	}
+
+	for _, r := range router.Routes {
+		if r.DestinationCIDR == route.DestinationCIDR && r.NextHop == nextHop {
+			// Already present.
+			return nil
+		}
+	}
+
+	newRoutes := append(router.Routes, routers.Route{
+		DestinationCIDR: route.DestinationCIDR,
+		NextHop:         nextHop,
+	})
+
+	_, err = routers.Update(os.network, os.routeOpts.RouterId, routers.UpdateOpts{
+		Routes: &newRoutes,
+	}).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to add route %s -> %s to router %s: %v", route.DestinationCIDR, nextHop, os.routeOpts.RouterId, err)
+	}
+	return nil
+}
+
+// DeleteRoute removes the extraroute previously installed by CreateRoute,
+// and, if a subnet pool is configured, returns the pod subnet it allocated
+// back to the pool. It matches the route by DestinationCIDR alone, which is
+// unique per node, rather than also resolving route.TargetInstance to an
+// address: DeleteRoute is routinely called after the node (and its Nova
+// server) is already gone, so resolving its address can no longer succeed.
+func (os *OpenStack) DeleteRoute(clusterName string, route *cloudprovider.Route) error {
+	router, err := routers.Get(os.network, os.routeOpts.RouterId).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to look up router %s: %v", os.routeOpts.RouterId, err)
+	}
+
+	newRoutes := make([]routers.Route, 0, len(router.Routes))
+	for _, r := range router.Routes {
+		if r.DestinationCIDR == route.DestinationCIDR {
+			continue
+		}
+		newRoutes = append(newRoutes, r)
+	}
+
+	_, err = routers.Update(os.network, os.routeOpts.RouterId, routers.UpdateOpts{
+		Routes: &newRoutes,
+	}).Extract()
+	if err != nil {
+		return fmt.Errorf("failed to remove route %s from router %s: %v", route.DestinationCIDR, os.routeOpts.RouterId, err)
+	}
+
+	if os.routeOpts.SubnetPoolId != "" {
+		if err := os.releasePodSubnet(route.DestinationCIDR); err != nil {
+			return fmt.Errorf("failed to release pod subnet %s: %v", route.DestinationCIDR, err)
+		}
+	}
+	return nil
+}
+
+// allocatePodSubnet creates a new subnet from the configured subnet pool,
+// attaches it to the route controller's router, and returns its CIDR. It is
+// idempotent per nameHint: since nothing in this package patches the
+// allocated CIDR back onto the Node object, the route controller will call
+// CreateRoute (and thus this function) again on every reconcile until it
+// does, so a subnet already allocated for nameHint is reused instead of
+// leaking a new subnet and router interface on each pass.
+func (os *OpenStack) allocatePodSubnet(nameHint string) (string, error) {
+	subnetName := fmt.Sprintf("kube-%s", nameHint)
+
+	if cidr, err := findSubnetCIDRByName(os.network, os.routeOpts.SubnetPoolId, subnetName); err != nil {
+		return "", fmt.Errorf("failed to check for an existing pod subnet named %s: %v", subnetName, err)
+	} else if cidr != "" {
+		return cidr, nil
+	}
+
+	prefixLen := os.routeOpts.NodeCIDRMaskSize
+	if prefixLen == 0 {
+		prefixLen = defaultNodeCIDRMaskSize
+	}
+
+	subnet, err := subnets.Create(os.network, subnets.CreateOpts{
+		Name:         subnetName,
+		SubnetPoolID: os.routeOpts.SubnetPoolId,
+		Prefixlen:    prefixLen,
+		IPVersion:    gophercloud.IPv4,
+	}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("failed to create a /%d subnet from pool %s: %v", prefixLen, os.routeOpts.SubnetPoolId, err)
+	}
+
+	_, err = routers.AddInterface(os.network, os.routeOpts.RouterId, routers.AddInterfaceOpts{
+		SubnetID: subnet.ID,
+	}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach subnet %s to router %s: %v", subnet.ID, os.routeOpts.RouterId, err)
+	}
+
+	return subnet.CIDR, nil
+}
+
+// releasePodSubnet detaches and deletes the subnet previously allocated by
+// allocatePodSubnet for the given CIDR.
+func (os *OpenStack) releasePodSubnet(cidr string) error {
+	subnetID, err := findSubnetIDByCIDR(os.network, os.routeOpts.SubnetPoolId, cidr)
+	if err != nil {
+		return err
+	}
+	if subnetID == "" {
+		// Already gone; nothing to do.
+		return nil
+	}
+
+	if _, err := routers.RemoveInterface(os.network, os.routeOpts.RouterId, routers.RemoveInterfaceOpts{
+		SubnetID: subnetID,
+	}).Extract(); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to detach subnet %s from router %s: %v", subnetID, os.routeOpts.RouterId, err)
+	}
+
+	if err := subnets.Delete(os.network, subnetID).ExtractErr(); err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to delete subnet %s: %v", subnetID, err)
+	}
+	return nil
+}
+
+// findSubnetCIDRByName returns the CIDR of the subnet with the given name in
+// subnetPoolID, or "" if no such subnet exists.
+func findSubnetCIDRByName(network *gophercloud.ServiceClient, subnetPoolID, name string) (string, error) {
+	var cidr string
+	err := subnets.List(network, subnets.ListOpts{SubnetPoolID: subnetPoolID, Name: name}).EachPage(func(page pagination.Page) (bool, error) {
+		list, err := subnets.ExtractSubnets(page)
+		if err != nil {
+			return false, err
+		}
+		if len(list) > 0 {
+			cidr = list[0].CIDR
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return cidr, nil
+}
+
+func findSubnetIDByCIDR(network *gophercloud.ServiceClient, subnetPoolID, cidr string) (string, error) {
+	var id string
+	err := subnets.List(network, subnets.ListOpts{SubnetPoolID: subnetPoolID, CIDR: cidr}).EachPage(func(page pagination.Page) (bool, error) {
+		list, err := subnets.ExtractSubnets(page)
+		if err != nil {
+			return false, err
+		}
+		if len(list) > 0 {
+			id = list[0].ID
+		}
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright 2014 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"k8s.io/kubernetes/pkg/cloudprovider"
+)
+
+const testRouterID = "rtr-1"
+
+func fakeNetworkClient(t *testing.T, handler http.HandlerFunc) (*gophercloud.ServiceClient, *httptest.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/routers/"+testRouterID, handler)
+	server := httptest.NewServer(mux)
+
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "faketoken"},
+		Endpoint:       server.URL + "/v2.0/",
+	}
+	return client, server
+}
+
+func TestValidateRouterModeRejectsCentralizedRouterWhenDistributedRequested(t *testing.T) {
+	client, server := fakeNetworkClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"router": {"id": "` + testRouterID + `", "distributed": false}}`))
+	})
+	defer server.Close()
+
+	opts := RouteOpts{RouterId: testRouterID, Distributed: true}
+	if err := validateRouterMode(client, opts); err == nil {
+		t.Fatal("expected an error requesting distributed=true against a centralized router, got nil")
+	}
+}
+
+func TestValidateRouterModeAcceptsMatchingDistributedRouter(t *testing.T) {
+	client, server := fakeNetworkClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"router": {"id": "` + testRouterID + `", "distributed": true}}`))
+	})
+	defer server.Close()
+
+	opts := RouteOpts{RouterId: testRouterID, Distributed: true}
+	if err := validateRouterMode(client, opts); err != nil {
+		t.Fatalf("expected no error for a matching distributed router, got: %v", err)
+	}
+}
+
+// fakeComputeClient sets up a fake Nova endpoint resolving the named server
+// to the given fixed IP, for tests exercising the node-name-to-address
+// resolution CreateRoute/ListRoutes perform against os.compute.
+func fakeComputeClient(t *testing.T, serverName, fixedIP string) (*gophercloud.ServiceClient, *httptest.Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/servers/detail", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"servers": [{"id": "srv-1", "name": "` + serverName + `", "status": "ACTIVE", ` +
+			`"addresses": {"private": [{"addr": "` + fixedIP + `", "OS-EXT-IPS:type": "fixed"}]}}]}`))
+	})
+	server := httptest.NewServer(mux)
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "faketoken"},
+		Endpoint:       server.URL + "/v2.0/",
+	}
+	return client, server
+}
+
+func TestCreateRouteSendsExtraRouteInUpdateBody(t *testing.T) {
+	var capturedBody string
+
+	networkClient, networkServer := fakeNetworkClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"router": {"id": "` + testRouterID + `", "routes": []}}`))
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("failed to read request body: %v", err)
+			}
+			capturedBody = string(body)
+			w.Write([]byte(`{"router": {"id": "` + testRouterID + `", "routes": [{"destination": "10.0.1.0/24", "nexthop": "10.0.0.5"}]}}`))
+		default:
+			t.Fatalf("unexpected method %s", r.Method)
+		}
+	})
+	defer networkServer.Close()
+
+	computeClient, computeServer := fakeComputeClient(t, "node-1", "10.0.0.5")
+	defer computeServer.Close()
+
+	os := &OpenStack{
+		network:   networkClient,
+		compute:   computeClient,
+		routeOpts: RouteOpts{RouterId: testRouterID},
+	}
+
+	route := &cloudprovider.Route{
+		DestinationCIDR: "10.0.1.0/24",
+		TargetInstance:  "node-1",
+	}
+	if err := os.CreateRoute("kubernetes", "hint", route); err != nil {
+		t.Fatalf("CreateRoute returned an error: %v", err)
+	}
+
+	var body struct {
+		Router struct {
+			Routes []struct {
+				Destination string `json:"destination"`
+				NextHop     string `json:"nexthop"`
+			} `json:"routes"`
+		} `json:"router"`
+	}
+	if err := json.Unmarshal([]byte(capturedBody), &body); err != nil {
+		t.Fatalf("could not parse PUT body %q: %v", capturedBody, err)
+	}
+	if len(body.Router.Routes) != 1 {
+		t.Fatalf("expected exactly one route in the update body, got %d: %s", len(body.Router.Routes), capturedBody)
+	}
+	got := body.Router.Routes[0]
+	if got.Destination != "10.0.1.0/24" || got.NextHop != "10.0.0.5" {
+		t.Fatalf("unexpected route in update body: %+v", got)
+	}
+	if !strings.Contains(capturedBody, "10.0.0.5") {
+		t.Fatalf("expected update body to reference the node's resolved IP, not its name, got %s", capturedBody)
+	}
+}
+
+const testSubnetPoolID = "pool-1"
+
+// fakeNeutronClient sets up a fake Neutron endpoint serving both the
+// subnets and router-interface APIs used by allocatePodSubnet,
+// releasePodSubnet and findSubnetIDByCIDR.
+func fakeNeutronClient(t *testing.T, mux *http.ServeMux) (*gophercloud.ServiceClient, *httptest.Server) {
+	server := httptest.NewServer(mux)
+	client := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "faketoken"},
+		Endpoint:       server.URL + "/v2.0/",
+	}
+	return client, server
+}
+
+func TestAllocatePodSubnetReusesExistingSubnetForSameNameHint(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/subnets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Fatalf("expected a GET to look up an existing subnet, got %s", r.Method)
+		}
+		if !strings.Contains(r.URL.RawQuery, "name=kube-node-1") {
+			t.Fatalf("expected the lookup to filter by name, got query %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subnets": [{"id": "subnet-1", "cidr": "10.0.1.0/24"}]}`))
+	})
+
+	client, server := fakeNeutronClient(t, mux)
+	defer server.Close()
+
+	os := &OpenStack{
+		network:   client,
+		routeOpts: RouteOpts{RouterId: testRouterID, SubnetPoolId: testSubnetPoolID},
+	}
+
+	cidr, err := os.allocatePodSubnet("node-1")
+	if err != nil {
+		t.Fatalf("allocatePodSubnet returned an error: %v", err)
+	}
+	if cidr != "10.0.1.0/24" {
+		t.Fatalf("expected the existing subnet's CIDR to be reused, got %s", cidr)
+	}
+}
+
+func TestAllocatePodSubnetCreatesAndAttachesWhenNoneExists(t *testing.T) {
+	var attachedSubnetID string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/subnets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"subnets": []}`))
+		case http.MethodPost:
+			w.Write([]byte(`{"subnet": {"id": "subnet-2", "cidr": "10.0.2.0/24"}}`))
+		default:
+			t.Fatalf("unexpected method %s", r.Method)
+		}
+	})
+	mux.HandleFunc("/v2.0/routers/"+testRouterID+"/add_router_interface", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("failed to read add_router_interface body: %v", err)
+		}
+		if !strings.Contains(string(body), "subnet-2") {
+			t.Fatalf("expected the new subnet to be attached, got body %s", body)
+		}
+		attachedSubnetID = "subnet-2"
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subnet_id": "subnet-2"}`))
+	})
+
+	client, server := fakeNeutronClient(t, mux)
+	defer server.Close()
+
+	os := &OpenStack{
+		network:   client,
+		routeOpts: RouteOpts{RouterId: testRouterID, SubnetPoolId: testSubnetPoolID},
+	}
+
+	cidr, err := os.allocatePodSubnet("node-2")
+	if err != nil {
+		t.Fatalf("allocatePodSubnet returned an error: %v", err)
+	}
+	if cidr != "10.0.2.0/24" {
+		t.Fatalf("expected the newly created subnet's CIDR, got %s", cidr)
+	}
+	if attachedSubnetID != "subnet-2" {
+		t.Fatal("expected the newly created subnet to be attached to the router")
+	}
+}
+
+func TestReleasePodSubnetDetachesAndDeletesSubnet(t *testing.T) {
+	var detached, deleted bool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/subnets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subnets": [{"id": "subnet-3", "cidr": "10.0.3.0/24"}]}`))
+	})
+	mux.HandleFunc("/v2.0/routers/"+testRouterID+"/remove_router_interface", func(w http.ResponseWriter, r *http.Request) {
+		detached = true
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subnet_id": "subnet-3"}`))
+	})
+	mux.HandleFunc("/v2.0/subnets/subnet-3", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Fatalf("expected a DELETE, got %s", r.Method)
+		}
+		deleted = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	client, server := fakeNeutronClient(t, mux)
+	defer server.Close()
+
+	os := &OpenStack{
+		network:   client,
+		routeOpts: RouteOpts{RouterId: testRouterID, SubnetPoolId: testSubnetPoolID},
+	}
+
+	if err := os.releasePodSubnet("10.0.3.0/24"); err != nil {
+		t.Fatalf("releasePodSubnet returned an error: %v", err)
+	}
+	if !detached {
+		t.Fatal("expected the subnet to be detached from the router")
+	}
+	if !deleted {
+		t.Fatal("expected the subnet to be deleted")
+	}
+}
+
+func TestFindSubnetIDByCIDR(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2.0/subnets", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.RawQuery, "cidr=10.0.4.0%2F24") {
+			t.Fatalf("expected the lookup to filter by CIDR, got query %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subnets": [{"id": "subnet-4", "cidr": "10.0.4.0/24"}]}`))
+	})
+
+	client, server := fakeNeutronClient(t, mux)
+	defer server.Close()
+
+	id, err := findSubnetIDByCIDR(client, testSubnetPoolID, "10.0.4.0/24")
+	if err != nil {
+		t.Fatalf("findSubnetIDByCIDR returned an error: %v", err)
+	}
+	if id != "subnet-4" {
+		t.Fatalf("expected subnet-4, got %s", id)
+	}
+}
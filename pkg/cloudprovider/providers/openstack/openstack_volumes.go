@@ -0,0 +1,467 @@
+/*
+Copyright 2014 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	volumes_v1 "github.com/gophercloud/gophercloud/openstack/blockstorage/v1/volumes"
+	volumes_v2 "github.com/gophercloud/gophercloud/openstack/blockstorage/v2/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	"github.com/gophercloud/gophercloud/pagination"
+
+	"github.com/golang/glog"
+)
+
+const (
+	volumeAvailableStatus = "available"
+	volumeInUseStatus     = "in-use"
+	volumeErrorStatus     = "error"
+
+	// time interval and timeout for polling volume/attachment status
+	volumeOperationPollInterval = 1 * time.Second
+	volumeOperationTimeout      = 180 * time.Second
+
+	diskByIDPath     = "/dev/disk/by-id/"
+	diskVirtioPrefix = "virtio-"
+)
+
+// ErrVolumeAttached is returned when an attach is attempted against a volume
+// that is already in use by a different server.
+type ErrVolumeAttached struct {
+	VolumeID string
+	ServerID string
+}
+
+func (e *ErrVolumeAttached) Error() string {
+	return fmt.Sprintf("volume %s is already attached to server %s", e.VolumeID, e.ServerID)
+}
+
+// BlockStorageOpts configures the Cinder client used for PersistentVolumes.
+type BlockStorageOpts struct {
+	BSVersion        string     `gcfg:"bs-version"`               // overrides autodetection: v1, v2, or auto (default)
+	TrustDevicePath  bool       `gcfg:"trust-device-path"`        // skip checking that the by-id device path exists in GetDevicePath
+	IgnoreVolumeAZ   bool       `gcfg:"ignore-volume-az"`         // disable AZ-aware scheduling (useful for single-AZ clouds)
+	OperationTimeout MyDuration `gcfg:"volume-operation-timeout"` // overrides volumeOperationTimeout when set
+}
+
+// volumeService abstracts over the differences between the Cinder v1 and v2
+// APIs so the rest of this file can stay version-agnostic.
+type volumeService interface {
+	createVolume(opts volumeCreateOpts) (string, error)
+	getVolume(volumeID string) (cinderVolume, error)
+	getVolumeByName(name string) (cinderVolume, error)
+	deleteVolume(volumeID string) error
+}
+
+// cinderVolume is the subset of volume fields this provider cares about,
+// normalized across the v1 and v2 APIs.
+type cinderVolume struct {
+	ID               string
+	Name             string
+	Status           string
+	AvailabilityZone string
+	Attachments      []volumeAttachment
+}
+
+type volumeAttachment struct {
+	ServerID string
+	Device   string
+}
+
+type volumeCreateOpts struct {
+	Size             int
+	Name             string
+	VolumeType       string
+	AvailabilityZone string
+	Tags             map[string]string
+}
+
+type volumeServiceV1 struct {
+	client *gophercloud.ServiceClient
+}
+
+func (v *volumeServiceV1) createVolume(opts volumeCreateOpts) (string, error) {
+	createOpts := volumes_v1.CreateOpts{
+		Name:             opts.Name,
+		Size:             opts.Size,
+		VolumeType:       opts.VolumeType,
+		AvailabilityZone: opts.AvailabilityZone,
+		Metadata:         opts.Tags,
+	}
+	vol, err := volumes_v1.Create(v.client, createOpts).Extract()
+	if err != nil {
+		return "", err
+	}
+	return vol.ID, nil
+}
+
+func (v *volumeServiceV1) getVolume(volumeID string) (cinderVolume, error) {
+	vol, err := volumes_v1.Get(v.client, volumeID).Extract()
+	if err != nil {
+		return cinderVolume{}, err
+	}
+	out := cinderVolume{
+		ID:               vol.ID,
+		Name:             vol.Name,
+		Status:           vol.Status,
+		AvailabilityZone: vol.AvailabilityZone,
+	}
+	for _, a := range vol.Attachments {
+		out.Attachments = append(out.Attachments, volumeAttachment{
+			ServerID: a["server_id"].(string),
+			Device:   a["device"].(string),
+		})
+	}
+	return out, nil
+}
+
+func (v *volumeServiceV1) getVolumeByName(name string) (cinderVolume, error) {
+	var found []cinderVolume
+	err := volumes_v1.List(v.client, volumes_v1.ListOpts{Name: name}).EachPage(func(page pagination.Page) (bool, error) {
+		vols, err := volumes_v1.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, vol := range vols {
+			cv := cinderVolume{ID: vol.ID, Name: vol.Name, Status: vol.Status, AvailabilityZone: vol.AvailabilityZone}
+			for _, a := range vol.Attachments {
+				cv.Attachments = append(cv.Attachments, volumeAttachment{
+					ServerID: a["server_id"].(string),
+					Device:   a["device"].(string),
+				})
+			}
+			found = append(found, cv)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return cinderVolume{}, err
+	}
+	if len(found) == 0 {
+		return cinderVolume{}, ErrNotFound
+	} else if len(found) > 1 {
+		return cinderVolume{}, ErrMultipleResults
+	}
+	return found[0], nil
+}
+
+func (v *volumeServiceV1) deleteVolume(volumeID string) error {
+	return volumes_v1.Delete(v.client, volumeID).ExtractErr()
+}
+
+type volumeServiceV2 struct {
+	client *gophercloud.ServiceClient
+}
+
+func (v *volumeServiceV2) createVolume(opts volumeCreateOpts) (string, error) {
+	createOpts := volumes_v2.CreateOpts{
+		Name:             opts.Name,
+		Size:             opts.Size,
+		VolumeType:       opts.VolumeType,
+		AvailabilityZone: opts.AvailabilityZone,
+		Metadata:         opts.Tags,
+	}
+	vol, err := volumes_v2.Create(v.client, createOpts).Extract()
+	if err != nil {
+		return "", err
+	}
+	return vol.ID, nil
+}
+
+func (v *volumeServiceV2) getVolume(volumeID string) (cinderVolume, error) {
+	vol, err := volumes_v2.Get(v.client, volumeID).Extract()
+	if err != nil {
+		return cinderVolume{}, err
+	}
+	out := cinderVolume{
+		ID:               vol.ID,
+		Name:             vol.Name,
+		Status:           vol.Status,
+		AvailabilityZone: vol.AvailabilityZone,
+	}
+	for _, a := range vol.Attachments {
+		out.Attachments = append(out.Attachments, volumeAttachment{
+			ServerID: a.ServerID,
+			Device:   a.Device,
+		})
+	}
+	return out, nil
+}
+
+func (v *volumeServiceV2) getVolumeByName(name string) (cinderVolume, error) {
+	var found []cinderVolume
+	err := volumes_v2.List(v.client, volumes_v2.ListOpts{Name: name}).EachPage(func(page pagination.Page) (bool, error) {
+		vols, err := volumes_v2.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, vol := range vols {
+			cv := cinderVolume{ID: vol.ID, Name: vol.Name, Status: vol.Status, AvailabilityZone: vol.AvailabilityZone}
+			for _, a := range vol.Attachments {
+				cv.Attachments = append(cv.Attachments, volumeAttachment{ServerID: a.ServerID, Device: a.Device})
+			}
+			found = append(found, cv)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return cinderVolume{}, err
+	}
+	if len(found) == 0 {
+		return cinderVolume{}, ErrNotFound
+	} else if len(found) > 1 {
+		return cinderVolume{}, ErrMultipleResults
+	}
+	return found[0], nil
+}
+
+func (v *volumeServiceV2) deleteVolume(volumeID string) error {
+	return volumes_v2.Delete(v.client, volumeID).ExtractErr()
+}
+
+// volumeService constructs a new Cinder ServiceClient on each call for
+// the API version selected by bs-version, falling back to v2 and then v1
+// when bs-version is "auto" or unset.
+func (os *OpenStack) volumeService() (volumeService, error) {
+	if os.bsOpts.BSVersion == "v1" {
+		client, err := openstack.NewBlockStorageV1(os.provider, gophercloud.EndpointOpts{Region: os.region})
+		if err != nil {
+			return nil, err
+		}
+		return &volumeServiceV1{client: client}, nil
+	}
+
+	if os.bsOpts.BSVersion == "v2" {
+		client, err := openstack.NewBlockStorageV2(os.provider, gophercloud.EndpointOpts{Region: os.region})
+		if err != nil {
+			return nil, err
+		}
+		return &volumeServiceV2{client: client}, nil
+	}
+
+	// auto: prefer v2, fall back to v1 for older clouds.
+	if client, err := openstack.NewBlockStorageV2(os.provider, gophercloud.EndpointOpts{Region: os.region}); err == nil {
+		return &volumeServiceV2{client: client}, nil
+	}
+
+	client, err := openstack.NewBlockStorageV1(os.provider, gophercloud.EndpointOpts{Region: os.region})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find a Cinder v1 or v2 endpoint: %v", err)
+	}
+	return &volumeServiceV1{client: client}, nil
+}
+
+// getVolumeByNameOrID looks a volume up by UUID first, falling back to a
+// name search since PersistentVolumes are frequently keyed by name.
+func (os *OpenStack) getVolumeByNameOrID(volumes volumeService, nameOrID string) (cinderVolume, error) {
+	vol, err := volumes.getVolume(nameOrID)
+	if err == nil {
+		return vol, nil
+	}
+	if !isNotFound(err) {
+		return cinderVolume{}, err
+	}
+	return volumes.getVolumeByName(nameOrID)
+}
+
+// CreateVolume creates a Cinder volume of the given size (in GB) and returns
+// its ID, its availability zone, and whether it ended up AZ-aware.
+func (os *OpenStack) CreateVolume(name string, size int, vtype, availability string, tags *map[string]string) (string, string, bool, error) {
+	volumes, err := os.volumeService()
+	if err != nil {
+		return "", "", false, err
+	}
+
+	opts := volumeCreateOpts{
+		Name:             name,
+		Size:             size,
+		VolumeType:       vtype,
+		AvailabilityZone: availability,
+	}
+	if tags != nil {
+		opts.Tags = *tags
+	}
+
+	volumeID, err := volumes.createVolume(opts)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to create a %d GB volume: %v", size, err)
+	}
+
+	vol, err := os.waitForVolumeStatus(volumes, volumeID, volumeAvailableStatus)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	glog.V(2).Infof("Created volume %s in zone %s", volumeID, vol.AvailabilityZone)
+	return volumeID, vol.AvailabilityZone, !os.bsOpts.IgnoreVolumeAZ, nil
+}
+
+// DeleteVolume deletes the named Cinder volume.
+func (os *OpenStack) DeleteVolume(volumeName string) error {
+	volumes, err := os.volumeService()
+	if err != nil {
+		return err
+	}
+	return volumes.deleteVolume(volumeName)
+}
+
+// AttachDisk attaches the named Cinder volume to the named server, returning
+// the Cinder-reported device path.
+func (os *OpenStack) AttachDisk(instanceID, volumeName string) (string, error) {
+	volumes, err := os.volumeService()
+	if err != nil {
+		return "", err
+	}
+
+	vol, err := os.getVolumeByNameOrID(volumes, volumeName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range vol.Attachments {
+		if a.ServerID != instanceID {
+			return "", &ErrVolumeAttached{VolumeID: vol.ID, ServerID: a.ServerID}
+		}
+		// Already attached to the server we were asked to attach to.
+		glog.V(4).Infof("Disk %s is already attached to instance %s", vol.ID, instanceID)
+		return a.Device, nil
+	}
+
+	_, err = volumeattach.Create(os.compute, instanceID, volumeattach.CreateOpts{
+		VolumeID: vol.ID,
+	}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach volume %s to instance %s: %v", vol.ID, instanceID, err)
+	}
+
+	attached, err := os.waitForVolumeStatus(volumes, vol.ID, volumeInUseStatus)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range attached.Attachments {
+		if a.ServerID == instanceID {
+			return a.Device, nil
+		}
+	}
+	return "", fmt.Errorf("volume %s did not report an attachment to instance %s", vol.ID, instanceID)
+}
+
+// DetachDisk detaches the named Cinder volume from the named server.
+func (os *OpenStack) DetachDisk(instanceID, volumeName string) error {
+	volumes, err := os.volumeService()
+	if err != nil {
+		return err
+	}
+
+	vol, err := os.getVolumeByNameOrID(volumes, volumeName)
+	if err != nil {
+		return err
+	}
+
+	attachedHere := false
+	for _, a := range vol.Attachments {
+		if a.ServerID == instanceID {
+			attachedHere = true
+		}
+	}
+	if !attachedHere {
+		return fmt.Errorf("disk %s is not attached to instance %s", vol.ID, instanceID)
+	}
+
+	if err := volumeattach.Delete(os.compute, instanceID, vol.ID).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to detach volume %s from instance %s: %v", vol.ID, instanceID, err)
+	}
+
+	_, err = os.waitForVolumeStatus(volumes, vol.ID, volumeAvailableStatus)
+	return err
+}
+
+// DiskIsAttached returns whether the named volume is currently attached to
+// the named server.
+func (os *OpenStack) DiskIsAttached(instanceID, volumeName string) (bool, error) {
+	volumes, err := os.volumeService()
+	if err != nil {
+		return false, err
+	}
+
+	vol, err := os.getVolumeByNameOrID(volumes, volumeName)
+	if err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, a := range vol.Attachments {
+		if a.ServerID == instanceID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetDevicePath returns the device path for an attached Cinder volume by its
+// short disk ID: the virtio udev alias that Nova's libvirt driver creates
+// under /dev/disk/by-id. Unless trust-device-path is set, it logs a warning
+// when that alias does not exist; the alias path is returned either way and
+// is not resolved to the kernel device it points at.
+func (os *OpenStack) GetDevicePath(volumeID string) string {
+	shortID := volumeID
+	if len(volumeID) > 20 {
+		shortID = volumeID[:20]
+	}
+	path := diskByIDPath + diskVirtioPrefix + shortID
+
+	if os.bsOpts.TrustDevicePath {
+		return path
+	}
+
+	if _, err := filepath.EvalSymlinks(path); err != nil {
+		glog.Warningf("Failed to find device for volume %s at %s: %v", volumeID, path, err)
+	}
+	return path
+}
+
+func (os *OpenStack) waitForVolumeStatus(volumes volumeService, volumeID, status string) (cinderVolume, error) {
+	timeout := volumeOperationTimeout
+	if os.bsOpts.OperationTimeout.Duration != 0 {
+		timeout = os.bsOpts.OperationTimeout.Duration
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		vol, err := volumes.getVolume(volumeID)
+		if err != nil {
+			return cinderVolume{}, err
+		}
+		if vol.Status == status {
+			return vol, nil
+		}
+		if vol.Status == volumeErrorStatus {
+			return cinderVolume{}, fmt.Errorf("volume %s entered error state while waiting for status %s", volumeID, status)
+		}
+		if time.Now().After(deadline) {
+			return cinderVolume{}, fmt.Errorf("timed out waiting for volume %s to reach status %s (last status %s)", volumeID, status, vol.Status)
+		}
+		time.Sleep(volumeOperationPollInterval)
+	}
+}